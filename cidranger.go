@@ -0,0 +1,94 @@
+// Package cidranger provides a dual-stack ranger.Ranger implementation that
+// dispatches lookups to a per-address-family trie, so callers get a single
+// Insert/Contains/ContainingNetworks API across both IPv4 and IPv6.
+package cidranger
+
+import (
+	"net"
+
+	"github.com/yl2chen/cidranger/ranger"
+	"github.com/yl2chen/cidranger/ranger/trie"
+)
+
+// versionedRanger is a ranger.Ranger that dispatches to the underlying
+// ranger.Ranger matching the address family of the network or ip it is
+// given.
+type versionedRanger struct {
+	ipV4Ranger ranger.Ranger
+	ipV6Ranger ranger.Ranger
+}
+
+// NewPCTrieRanger returns a ranger.Ranger backed by a path-compressed trie
+// per address family.
+func NewPCTrieRanger() ranger.Ranger {
+	return &versionedRanger{
+		ipV4Ranger: trie.NewPrefixTreeV4(),
+		ipV6Ranger: trie.NewPrefixTreeV6(),
+	}
+}
+
+func (v *versionedRanger) rangerFor(ip net.IP) (ranger.Ranger, error) {
+	if ip.To4() != nil {
+		return v.ipV4Ranger, nil
+	}
+	if ip.To16() != nil {
+		return v.ipV6Ranger, nil
+	}
+	return nil, ranger.ErrInvalidNetworkNumberInput
+}
+
+func (v *versionedRanger) Insert(network net.IPNet) error {
+	r, err := v.rangerFor(network.IP)
+	if err != nil {
+		return err
+	}
+	return r.Insert(network)
+}
+
+func (v *versionedRanger) InsertEntry(network net.IPNet, value interface{}) error {
+	r, err := v.rangerFor(network.IP)
+	if err != nil {
+		return err
+	}
+	return r.InsertEntry(network, value)
+}
+
+func (v *versionedRanger) Remove(network net.IPNet) (*net.IPNet, error) {
+	r, err := v.rangerFor(network.IP)
+	if err != nil {
+		return nil, err
+	}
+	return r.Remove(network)
+}
+
+func (v *versionedRanger) RemoveEntry(network net.IPNet) (*ranger.RangerEntry, error) {
+	r, err := v.rangerFor(network.IP)
+	if err != nil {
+		return nil, err
+	}
+	return r.RemoveEntry(network)
+}
+
+func (v *versionedRanger) Contains(ip net.IP) (bool, error) {
+	r, err := v.rangerFor(ip)
+	if err != nil {
+		return false, err
+	}
+	return r.Contains(ip)
+}
+
+func (v *versionedRanger) ContainingNetworks(ip net.IP) ([]net.IPNet, error) {
+	r, err := v.rangerFor(ip)
+	if err != nil {
+		return nil, err
+	}
+	return r.ContainingNetworks(ip)
+}
+
+func (v *versionedRanger) ContainingNetworkEntries(ip net.IP) ([]ranger.RangerEntry, error) {
+	r, err := v.rangerFor(ip)
+	if err != nil {
+		return nil, err
+	}
+	return r.ContainingNetworkEntries(ip)
+}
@@ -0,0 +1,64 @@
+package cidranger
+
+import (
+	"net"
+	"testing"
+
+	"github.com/yl2chen/cidranger/ranger"
+)
+
+func mustParseCIDR(t *testing.T, s string) net.IPNet {
+	t.Helper()
+	_, n, err := net.ParseCIDR(s)
+	if err != nil {
+		t.Fatalf("ParseCIDR(%q): %v", s, err)
+	}
+	return *n
+}
+
+func TestVersionedRangerDualStack(t *testing.T) {
+	r := NewPCTrieRanger()
+	if err := r.Insert(mustParseCIDR(t, "10.0.0.0/8")); err != nil {
+		t.Fatalf("Insert(v4): %v", err)
+	}
+	if err := r.Insert(mustParseCIDR(t, "2001:db8::/32")); err != nil {
+		t.Fatalf("Insert(v6): %v", err)
+	}
+
+	for _, tc := range []struct {
+		ip   string
+		want bool
+	}{
+		{"10.1.2.3", true},
+		{"11.0.0.1", false},
+		{"2001:db8::1", true},
+		{"2001:db9::1", false},
+	} {
+		got, err := r.Contains(net.ParseIP(tc.ip))
+		if err != nil {
+			t.Fatalf("Contains(%s): %v", tc.ip, err)
+		}
+		if got != tc.want {
+			t.Errorf("Contains(%s) = %v, want %v", tc.ip, got, tc.want)
+		}
+	}
+
+	if _, err := r.Remove(mustParseCIDR(t, "10.0.0.0/8")); err != nil {
+		t.Fatalf("Remove: %v", err)
+	}
+	got, err := r.Contains(net.ParseIP("10.1.2.3"))
+	if err != nil {
+		t.Fatalf("Contains after remove: %v", err)
+	}
+	if got {
+		t.Errorf("Contains(10.1.2.3) = true after removing 10.0.0.0/8, want false")
+	}
+}
+
+func TestVersionedRangerInvalidInput(t *testing.T) {
+	r := NewPCTrieRanger()
+	_, err := r.Contains(net.IP("not an ip"))
+	if err != ranger.ErrInvalidNetworkNumberInput {
+		t.Errorf("Contains(invalid ip) error = %v, want ErrInvalidNetworkNumberInput", err)
+	}
+}
@@ -0,0 +1,202 @@
+// Package net provides the IP address utilities used by the trie package
+// to do CIDR containment lookups: a comparable, maskable representation of
+// an IP address (NetworkNumber), and a CIDR block built on top of it
+// (Network). Both IPv4 and IPv6 addresses are supported; the number of
+// 32-bit words in a NetworkNumber (1 for IPv4, 4 for IPv6) determines which
+// family it represents.
+package net
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math/bits"
+	"net"
+)
+
+// NetworkNumber is a comparable, maskable representation of an IP address,
+// stored as one (IPv4) or four (IPv6) big-endian uint32 words, most
+// significant word first.
+type NetworkNumber []uint32
+
+// NewNetworkNumber returns the NetworkNumber representation of ip, or nil
+// if ip is neither a valid IPv4 nor IPv6 address.
+func NewNetworkNumber(ip net.IP) NetworkNumber {
+	ip4 := ip.To4()
+	if ip4 != nil {
+		return NetworkNumber{binary.BigEndian.Uint32(ip4)}
+	}
+	ip6 := ip.To16()
+	if ip6 == nil {
+		return nil
+	}
+	return NetworkNumber{
+		binary.BigEndian.Uint32(ip6[0:4]),
+		binary.BigEndian.Uint32(ip6[4:8]),
+		binary.BigEndian.Uint32(ip6[8:12]),
+		binary.BigEndian.Uint32(ip6[12:16]),
+	}
+}
+
+// Bits returns the total number of bits in n: 32 for IPv4, 128 for IPv6.
+func (n NetworkNumber) Bits() uint {
+	return uint(len(n)) * 32
+}
+
+// Bit returns the bit at position (0 being the least significant bit, Bits()-1
+// the most significant) of the network number.
+func (n NetworkNumber) Bit(position uint) (uint32, error) {
+	totalBits := n.Bits()
+	if position >= totalBits {
+		return 0, fmt.Errorf("position %d out of range for network number of %d bits", position, totalBits)
+	}
+	word := len(n) - 1 - int(position/32)
+	return (n[word] >> (position % 32)) & 1, nil
+}
+
+// LeastCommonBitPosition returns the position (using the same
+// 0-indexed-from-LSB convention as Bit, plus one) of the most significant
+// bit at which n and other diverge, or 0 if the two are identical.
+func (n NetworkNumber) LeastCommonBitPosition(other NetworkNumber) (uint, error) {
+	if len(n) != len(other) {
+		return 0, fmt.Errorf("mismatched network number lengths: %d vs %d", len(n), len(other))
+	}
+	for i, word := range n {
+		diff := word ^ other[i]
+		if diff == 0 {
+			continue
+		}
+		trailingWords := uint(len(n) - i - 1)
+		return uint(bits.Len32(diff)) + trailingWords*32, nil
+	}
+	return 0, nil
+}
+
+// Equal returns true if n and other hold the same words.
+func (n NetworkNumber) Equal(other NetworkNumber) bool {
+	if len(n) != len(other) {
+		return false
+	}
+	for i := range n {
+		if n[i] != other[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// mask zeroes out all but the leading ones bits of n.
+func (n NetworkNumber) mask(ones int) NetworkNumber {
+	totalBits := int(n.Bits())
+	if ones < 0 {
+		ones = 0
+	}
+	if ones > totalBits {
+		ones = totalBits
+	}
+	masked := make(NetworkNumber, len(n))
+	remaining := ones
+	for i := range n {
+		switch {
+		case remaining >= 32:
+			masked[i] = n[i]
+			remaining -= 32
+		case remaining <= 0:
+			masked[i] = 0
+		default:
+			masked[i] = n[i] & (^uint32(0) << uint(32-remaining))
+			remaining = 0
+		}
+	}
+	return masked
+}
+
+// maskWords returns the literal bit pattern of a wordCount-word mask with
+// its leading ones bits set, for use against a NetworkNumber of the same
+// word count.
+func maskWords(wordCount, ones int) NetworkNumber {
+	totalBits := wordCount * 32
+	if ones < 0 {
+		ones = 0
+	}
+	if ones > totalBits {
+		ones = totalBits
+	}
+	words := make(NetworkNumber, wordCount)
+	remaining := ones
+	for i := range words {
+		switch {
+		case remaining >= 32:
+			words[i] = ^uint32(0)
+			remaining -= 32
+		case remaining <= 0:
+			words[i] = 0
+		default:
+			words[i] = ^uint32(0) << uint(32-remaining)
+			remaining = 0
+		}
+	}
+	return words
+}
+
+// Network is a CIDR block paired with its NetworkNumber representation and
+// a precomputed mask, so trie nodes can test containment with a single
+// XOR-and-mask pass per word, without reparsing the net.IPNet or
+// re-deriving the mask on every lookup.
+type Network struct {
+	IPNet  net.IPNet
+	Number NetworkNumber
+	mask   NetworkNumber
+}
+
+// NewNetwork returns a new Network wrapping ipNet.
+func NewNetwork(ipNet net.IPNet) Network {
+	number := NewNetworkNumber(ipNet.IP)
+	ones, _ := ipNet.Mask.Size()
+	return Network{
+		IPNet:  ipNet,
+		Number: number,
+		mask:   maskWords(len(number), ones),
+	}
+}
+
+// Masked returns a new Network with only the leading ones bits of the
+// network number retained.
+func (n Network) Masked(ones int) Network {
+	mask := net.CIDRMask(ones, int(n.Number.Bits()))
+	return Network{
+		IPNet:  net.IPNet{IP: n.IPNet.IP.Mask(mask), Mask: mask},
+		Number: n.Number.mask(ones),
+		mask:   maskWords(len(n.Number), ones),
+	}
+}
+
+// Equal returns true if n and other share the same IP and mask.
+func (n Network) Equal(other Network) bool {
+	return n.IPNet.IP.Equal(other.IPNet.IP) && n.IPNet.Mask.String() == other.IPNet.Mask.String()
+}
+
+// Contains returns true if number falls within n. It compares
+// (number ^ n.Number) & n.mask one word at a time, so it neither allocates
+// nor reparses n.IPNet.Mask the way a naive re-mask-and-compare would.
+func (n Network) Contains(number NetworkNumber) bool {
+	if len(number) != len(n.Number) {
+		return false
+	}
+	for i, word := range number {
+		if (word^n.Number[i])&n.mask[i] != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// LeastCommonBitPosition returns the least common bit position between the
+// network numbers of n and other.
+func (n Network) LeastCommonBitPosition(other Network) (uint, error) {
+	return n.Number.LeastCommonBitPosition(other.Number)
+}
+
+// String returns the network's CIDR notation.
+func (n Network) String() string {
+	return n.IPNet.String()
+}
@@ -0,0 +1,81 @@
+package net
+
+import (
+	"net"
+	"testing"
+)
+
+func mustParseCIDR(t *testing.T, s string) Network {
+	t.Helper()
+	_, n, err := net.ParseCIDR(s)
+	if err != nil {
+		t.Fatalf("ParseCIDR(%q): %v", s, err)
+	}
+	return NewNetwork(*n)
+}
+
+func TestNetworkNumberBit(t *testing.T) {
+	n := NewNetworkNumber(net.ParseIP("128.0.0.1"))
+	bit, err := n.Bit(n.Bits() - 1)
+	if err != nil {
+		t.Fatalf("Bit: %v", err)
+	}
+	if bit != 1 {
+		t.Errorf("Bit(MSB) = %d, want 1 for 128.0.0.1", bit)
+	}
+	bit, err = n.Bit(0)
+	if err != nil {
+		t.Fatalf("Bit: %v", err)
+	}
+	if bit != 1 {
+		t.Errorf("Bit(LSB) = %d, want 1 for 128.0.0.1", bit)
+	}
+	if _, err := n.Bit(n.Bits()); err == nil {
+		t.Errorf("Bit(out of range) = nil error, want an error")
+	}
+}
+
+func TestLeastCommonBitPosition(t *testing.T) {
+	a := NewNetworkNumber(net.ParseIP("255.255.255.255"))
+	b := NewNetworkNumber(net.ParseIP("255.255.255.255"))
+	pos, err := a.LeastCommonBitPosition(b)
+	if err != nil {
+		t.Fatalf("LeastCommonBitPosition: %v", err)
+	}
+	if pos != 0 {
+		t.Errorf("LeastCommonBitPosition(identical) = %d, want 0", pos)
+	}
+
+	c := NewNetworkNumber(net.ParseIP("0.0.0.0"))
+	pos, err = a.LeastCommonBitPosition(c)
+	if err != nil {
+		t.Fatalf("LeastCommonBitPosition: %v", err)
+	}
+	if pos != 32 {
+		t.Errorf("LeastCommonBitPosition(all bits diverge) = %d, want 32", pos)
+	}
+}
+
+func TestNetworkContains(t *testing.T) {
+	n := mustParseCIDR(t, "10.0.0.0/8")
+	for _, tc := range []struct {
+		ip   string
+		want bool
+	}{
+		{"10.1.2.3", true},
+		{"11.0.0.1", false},
+	} {
+		got := n.Contains(NewNetworkNumber(net.ParseIP(tc.ip)))
+		if got != tc.want {
+			t.Errorf("Contains(%s) = %v, want %v", tc.ip, got, tc.want)
+		}
+	}
+}
+
+func TestNetworkMasked(t *testing.T) {
+	n := mustParseCIDR(t, "10.1.2.3/24")
+	masked := n.Masked(16)
+	if masked.String() != "10.1.0.0/16" {
+		t.Errorf("Masked(16) = %s, want 10.1.0.0/16", masked.String())
+	}
+}
@@ -0,0 +1,33 @@
+// Package ranger provides the interface implemented by cidranger's backing
+// data structures (currently the trie package in ranger/trie), along with
+// the sentinel errors and shared types those implementations return.
+package ranger
+
+import (
+	"errors"
+	"net"
+)
+
+// Ranger is the interface implemented by cidranger's backing data
+// structures, exposing containment lookups over a set of inserted CIDR
+// blocks.
+type Ranger interface {
+	Insert(network net.IPNet) error
+	Remove(network net.IPNet) (*net.IPNet, error)
+	Contains(ip net.IP) (bool, error)
+	ContainingNetworks(ip net.IP) ([]net.IPNet, error)
+
+	InsertEntry(network net.IPNet, value interface{}) error
+	RemoveEntry(network net.IPNet) (*RangerEntry, error)
+	ContainingNetworkEntries(ip net.IP) ([]RangerEntry, error)
+}
+
+// RangerEntry pairs a CIDR block with the caller-supplied value associated
+// with it at insertion time, as returned by the entry-aware lookup methods.
+type RangerEntry struct {
+	Network net.IPNet
+	Value   interface{}
+}
+
+// ErrInvalidNetworkNumberInput is returned upon invalid network input.
+var ErrInvalidNetworkNumberInput = errors.New("invalid network number input")
@@ -14,19 +14,23 @@ Path compression compresses a string of node with only 1 child into a single
 node, decrease the amount of lookups necessary during containment tests.
 
 Level compression dictates the amount of direct children of a node by allowing
-it to handle multiple bits in the path.  The heuristic (based on children
-population) to decide when the compression and decompression happens is outlined
-in the prior linked blog, and will be experimented with in more depth in this
-project in the future.
-
-TODO: Implement level-compressed component of the LPC trie.
-TODO: Add support for ipV6.
+it to handle multiple bits in the path. After every insert and remove, a
+node expands to handle one more bit once its populated-child fraction
+crosses Option's expand threshold, and shrinks back down once that fraction
+drops below the shrink threshold, within the min/max bits configured via
+WithMinBitsHandled/WithMaxBitsHandled.
 
+A PrefixTrie is specific to one address family: use NewPrefixTreeV4 for IPv4
+ranges and NewPrefixTreeV6 for IPv6 ranges. Both share the same bit-level
+logic, operating on the rnet.NetworkNumber's word count (1 for IPv4, 4 for
+IPv6) rather than a hard-coded bit width.
 */
 package trie
 
 import (
+	"bufio"
 	"fmt"
+	"io"
 	"net"
 	"strings"
 
@@ -35,7 +39,6 @@ import (
 )
 
 // PrefixTrie is a level-path-compressed (LPC) trie for cidr ranges.
-// TODO: Implement level-compressed capability
 type PrefixTrie struct {
 	parent   *PrefixTrie
 	children []*PrefixTrie
@@ -45,45 +48,141 @@ type PrefixTrie struct {
 
 	network  rnet.Network
 	hasEntry bool
+	entry    interface{}
+
+	config *trieConfig
 }
 
-// NewPrefixTree creates a new PrefixTrie.
-func NewPrefixTree() *PrefixTrie {
-	_, rootNet, _ := net.ParseCIDR("0.0.0.0/0")
+// trieConfig holds the level-compression tunables shared by every node of
+// a PrefixTrie.
+type trieConfig struct {
+	minBitsHandled  uint
+	maxBitsHandled  uint
+	expandThreshold float64
+	shrinkThreshold float64
+}
+
+const (
+	defaultMinBitsHandled  = 1
+	defaultMaxBitsHandled  = 4
+	defaultExpandThreshold = 0.5
+	defaultShrinkThreshold = 0.25
+)
+
+// Option configures the level-compression tunables of a PrefixTrie created
+// by NewPrefixTreeV4 or NewPrefixTreeV6.
+type Option func(*trieConfig)
+
+// WithMinBitsHandled sets the floor below which resize never shrinks a
+// node. New nodes always start out handling one bit and reach a higher
+// floor only by expanding. Defaults to 1.
+func WithMinBitsHandled(bits uint) Option {
+	return func(c *trieConfig) { c.minBitsHandled = bits }
+}
+
+// WithMaxBitsHandled sets the most bits a node may handle at once; nodes
+// never expand beyond it. Defaults to 4.
+func WithMaxBitsHandled(bits uint) Option {
+	return func(c *trieConfig) { c.maxBitsHandled = bits }
+}
+
+// WithExpandThreshold sets the populated-child fraction (of the node's 2^k
+// slots) at or above which a node expands to handle one more bit. Defaults
+// to 0.5.
+func WithExpandThreshold(fraction float64) Option {
+	return func(c *trieConfig) { c.expandThreshold = fraction }
+}
 
+// WithShrinkThreshold sets the populated-child fraction below which a node
+// gives up a bit of level compression. Defaults to 0.25.
+func WithShrinkThreshold(fraction float64) Option {
+	return func(c *trieConfig) { c.shrinkThreshold = fraction }
+}
+
+func newTrieConfig(opts []Option) *trieConfig {
+	config := &trieConfig{
+		minBitsHandled:  defaultMinBitsHandled,
+		maxBitsHandled:  defaultMaxBitsHandled,
+		expandThreshold: defaultExpandThreshold,
+		shrinkThreshold: defaultShrinkThreshold,
+	}
+	for _, opt := range opts {
+		opt(config)
+	}
+	return config
+}
+
+func newPrefixTree(rootNet net.IPNet, config *trieConfig) *PrefixTrie {
 	return &PrefixTrie{
 		children:       make([]*PrefixTrie, 2, 2),
 		numBitsSkipped: 0,
 		numBitsHandled: 1,
-		network:        rnet.NewNetwork(*rootNet),
+		network:        rnet.NewNetwork(rootNet),
+		config:         config,
 	}
 }
 
-func newPathPrefixTrie(network rnet.Network, numBitsSkipped uint) (*PrefixTrie, error) {
-	path := NewPrefixTree()
+// NewPrefixTreeV4 creates a new PrefixTrie for IPv4 cidr ranges.
+func NewPrefixTreeV4(opts ...Option) *PrefixTrie {
+	_, rootNet, _ := net.ParseCIDR("0.0.0.0/0")
+	return newPrefixTree(*rootNet, newTrieConfig(opts))
+}
+
+// NewPrefixTreeV6 creates a new PrefixTrie for IPv6 cidr ranges.
+func NewPrefixTreeV6(opts ...Option) *PrefixTrie {
+	_, rootNet, _ := net.ParseCIDR("::/0")
+	return newPrefixTree(*rootNet, newTrieConfig(opts))
+}
+
+func newPathPrefixTrie(network rnet.Network, numBitsSkipped uint, config *trieConfig) (*PrefixTrie, error) {
+	totalBits := int(network.Number.Bits())
+	rootNet := net.IPNet{IP: make(net.IP, totalBits/8), Mask: net.CIDRMask(0, totalBits)}
+	path := newPrefixTree(rootNet, config)
 	path.numBitsSkipped = numBitsSkipped
 	path.network = network.Masked(int(numBitsSkipped))
 	return path, nil
 }
 
-func newEntryTrie(network rnet.Network) (*PrefixTrie, error) {
+func newEntryTrie(network rnet.Network, value interface{}, config *trieConfig) (*PrefixTrie, error) {
 	ones, _ := network.IPNet.Mask.Size()
-	leaf, err := newPathPrefixTrie(network, uint(ones))
+	leaf, err := newPathPrefixTrie(network, uint(ones), config)
 	if err != nil {
 		return nil, err
 	}
 	leaf.hasEntry = true
+	leaf.entry = value
 	return leaf, nil
 }
 
 // Insert inserts the given cidr range into prefix trie.
 func (p *PrefixTrie) Insert(network net.IPNet) error {
-	return p.insert(rnet.NewNetwork(network))
+	return p.insert(rnet.NewNetwork(network), nil)
+}
+
+// InsertEntry inserts the given cidr range into prefix trie, associating
+// value with it so it can be retrieved via ContainingNetworkEntries or
+// RemoveEntry.
+func (p *PrefixTrie) InsertEntry(network net.IPNet, value interface{}) error {
+	return p.insert(rnet.NewNetwork(network), value)
 }
 
 // Remove removes network from trie.
 func (p *PrefixTrie) Remove(network net.IPNet) (*net.IPNet, error) {
-	return p.remove(rnet.NewNetwork(network))
+	removed, err := p.remove(rnet.NewNetwork(network))
+	if err != nil || removed == nil {
+		return nil, err
+	}
+	return &removed.network.IPNet, nil
+}
+
+// RemoveEntry removes network from trie, returning the entry that was
+// associated with it.
+func (p *PrefixTrie) RemoveEntry(network net.IPNet) (*ranger.RangerEntry, error) {
+	removed, err := p.remove(rnet.NewNetwork(network))
+	if err != nil || removed == nil {
+		return nil, err
+	}
+	return &ranger.RangerEntry{Network: removed.network.IPNet, Value: removed.entry}, nil
 }
 
 // Contains returns boolean indicating whether given ip is contained in any
@@ -106,6 +205,118 @@ func (p *PrefixTrie) ContainingNetworks(ip net.IP) ([]net.IPNet, error) {
 	return p.containingNetworks(nn)
 }
 
+// ContainingNetworkEntries returns the list of entries whose networks
+// given ip is a part of, in ascending prefix order.
+func (p *PrefixTrie) ContainingNetworkEntries(ip net.IP) ([]ranger.RangerEntry, error) {
+	nn := rnet.NewNetworkNumber(ip)
+	if nn == nil {
+		return nil, ranger.ErrInvalidNetworkNumberInput
+	}
+	return p.containingNetworkEntries(nn)
+}
+
+// LongestPrefixMatch returns the most specific network containing ip and
+// the value associated with it, or a nil network if ip isn't contained in
+// any inserted network. Unlike ContainingNetworkEntries, it doesn't
+// allocate a result slice; it walks down iteratively and stops as soon as
+// there's no matching child left to try.
+func (p *PrefixTrie) LongestPrefixMatch(ip net.IP) (*net.IPNet, interface{}, error) {
+	nn := rnet.NewNetworkNumber(ip)
+	if nn == nil {
+		return nil, nil, ranger.ErrInvalidNetworkNumberInput
+	}
+	return p.longestPrefixMatch(nn)
+}
+
+// Walk visits every inserted network in prefix order (an ancestor before
+// its descendants), calling fn with the network and its associated value.
+// It stops as soon as fn returns false.
+func (p *PrefixTrie) Walk(fn func(network net.IPNet, value interface{}) bool) error {
+	_, err := p.walk(fn)
+	return err
+}
+
+// WalkSubtree is Walk scoped to the entries at or beneath prefix: it
+// descends directly to the node covering prefix, then walks from there.
+// Where prefix ends partway through the bits a level-compressed node
+// consumes, it walks that node's whole subtree instead, passing fn only the
+// networks at or beneath prefix.
+func (p *PrefixTrie) WalkSubtree(prefix net.IPNet, fn func(network net.IPNet, value interface{}) bool) error {
+	ones, _ := prefix.Mask.Size()
+	network := rnet.NewNetwork(prefix).Masked(ones)
+	node := p
+	for node.numBitsSkipped < uint(ones) {
+		slots, err := node.matchingSlots(network)
+		if err != nil {
+			return err
+		}
+		if len(slots) > 1 {
+			_, err := node.walk(func(n net.IPNet, v interface{}) bool {
+				nOnes, _ := n.Mask.Size()
+				return nOnes < ones || !network.Contains(rnet.NewNetworkNumber(n.IP)) || fn(n, v)
+			})
+			return err
+		}
+		child := node.children[slots[0]]
+		if child == nil {
+			return nil
+		}
+		node = child
+	}
+	if !node.network.Masked(ones).Equal(network) {
+		return nil
+	}
+	_, err := node.walk(fn)
+	return err
+}
+
+// walk is the recursive implementation backing Walk and WalkSubtree. The
+// returned bool is false once fn has asked to stop, so callers can
+// propagate early termination back up without a sentinel error.
+func (p *PrefixTrie) walk(fn func(network net.IPNet, value interface{}) bool) (bool, error) {
+	if p.hasEntry {
+		if !fn(p.network.IPNet, p.entry) {
+			return false, nil
+		}
+	}
+	for i, child := range p.children {
+		// A shallow child can occupy a run of adjacent slots (see
+		// matchingSlots and expand); visit it only once.
+		if child == nil || (i > 0 && child == p.children[i-1]) {
+			continue
+		}
+		cont, err := child.walk(fn)
+		if err != nil || !cont {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// LoadFromReader bulk-inserts the CIDR blocks read from r, one per line.
+// Blank lines and lines starting with "#" are skipped. It returns the
+// number of networks successfully inserted and the first error
+// encountered, if any.
+func (p *PrefixTrie) LoadFromReader(r io.Reader) (int, error) {
+	scanner := bufio.NewScanner(r)
+	count := 0
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		_, network, err := net.ParseCIDR(line)
+		if err != nil {
+			return count, fmt.Errorf("trie: parsing %q: %w", line, err)
+		}
+		if err := p.Insert(*network); err != nil {
+			return count, err
+		}
+		count++
+	}
+	return count, scanner.Err()
+}
+
 // String returns string representation of trie, mainly for visualization and
 // debugging.
 func (p *PrefixTrie) String() string {
@@ -140,13 +351,44 @@ func (p *PrefixTrie) contains(number rnet.NetworkNumber) (bool, error) {
 	return false, nil
 }
 
+func (p *PrefixTrie) longestPrefixMatch(number rnet.NetworkNumber) (*net.IPNet, interface{}, error) {
+	var network *net.IPNet
+	var value interface{}
+	for node := p; node != nil; {
+		if !node.network.Contains(number) {
+			break
+		}
+		if node.hasEntry {
+			network, value = &node.network.IPNet, node.entry
+		}
+		bit, err := node.targetBitFromIP(number)
+		if err != nil {
+			return nil, nil, err
+		}
+		node = node.children[bit]
+	}
+	return network, value, nil
+}
+
 func (p *PrefixTrie) containingNetworks(number rnet.NetworkNumber) ([]net.IPNet, error) {
-	results := []net.IPNet{}
+	entries, err := p.containingNetworkEntries(number)
+	if err != nil {
+		return nil, err
+	}
+	results := make([]net.IPNet, 0, len(entries))
+	for _, entry := range entries {
+		results = append(results, entry.Network)
+	}
+	return results, nil
+}
+
+func (p *PrefixTrie) containingNetworkEntries(number rnet.NetworkNumber) ([]ranger.RangerEntry, error) {
+	results := []ranger.RangerEntry{}
 	if !p.network.Contains(number) {
 		return results, nil
 	}
 	if p.hasEntry {
-		results = []net.IPNet{p.network.IPNet}
+		results = []ranger.RangerEntry{{Network: p.network.IPNet, Value: p.entry}}
 	}
 	bit, err := p.targetBitFromIP(number)
 	if err != nil {
@@ -154,51 +396,215 @@ func (p *PrefixTrie) containingNetworks(number rnet.NetworkNumber) ([]net.IPNet,
 	}
 	child := p.children[bit]
 	if child != nil {
-		ranges, err := child.containingNetworks(number)
+		entries, err := child.containingNetworkEntries(number)
 		if err != nil {
 			return nil, err
 		}
-		if len(ranges) > 0 {
-			results = append(results, ranges...)
+		if len(entries) > 0 {
+			results = append(results, entries...)
 		}
 	}
 	return results, nil
 }
 
-func (p *PrefixTrie) insert(network rnet.Network) error {
+func (p *PrefixTrie) insert(network rnet.Network, value interface{}) error {
 	if p.network.Equal(network) {
 		p.hasEntry = true
+		p.entry = value
 		return nil
 	}
-	bit, err := p.targetBitFromIP(network.Number)
+	entry, err := newEntryTrie(network, value, p.config)
 	if err != nil {
 		return err
 	}
-	child := p.children[bit]
-	if child == nil {
-		var entry *PrefixTrie
-		entry, err = newEntryTrie(network)
-		if err != nil {
-			return err
+	return p.graft(entry)
+}
+
+// graft places node (and, if node already has descendants of its own,
+// everything beneath it) at the position node's own network dictates
+// within p. This is insert's recursive placement logic, generalized to
+// move an existing subtree rather than always build a fresh leaf: a
+// normal insert grafts a brand new one-entry node; multi-slot placement
+// (see placeInSlots) and absorbChildren graft an already-populated one.
+func (p *PrefixTrie) graft(node *PrefixTrie) error {
+	if p.network.Equal(node.network) {
+		if node.hasEntry {
+			p.hasEntry = true
+			p.entry = node.entry
 		}
-		return p.insertPrefix(bit, entry)
+		// node may itself be a populated subtree rather than a fresh leaf
+		// (placeInSlots calls graft with the new node and an existing
+		// occupant in either role) -- its children need to move over to p
+		// too, or they're simply dropped along with node.
+		return p.absorbChildren(node)
 	}
 
-	lcb, err := network.LeastCommonBitPosition(child.network)
+	slots, err := p.matchingSlots(node.network)
 	if err != nil {
 		return err
 	}
-	if lcb-1 > child.targetBitPosition() {
-		child, err = newPathPrefixTrie(network, 32-lcb)
+
+	if child := p.uniformOccupant(slots); child != nil {
+		if child == node {
+			return nil
+		}
+		lcb, err := node.network.LeastCommonBitPosition(child.network)
 		if err != nil {
 			return err
 		}
-		err := p.insertPrefix(bit, child)
+		// The bits node.network and child.network actually share can't
+		// exceed either side's own declared prefix length: past that
+		// length the stored bits are just zero padding, and any agreement
+		// there is coincidental rather than a real shared prefix. Clamp
+		// the raw bit count lcb gives us by both before deciding whether,
+		// and where, to split, or a broad network grafted after a
+		// narrower one can end up planted as a descendant of a split node
+		// masked more specifically than the broad network itself, which
+		// then prunes it out of lookups.
+		commonBits := node.network.Number.Bits() - lcb
+		if node.numBitsSkipped < commonBits {
+			commonBits = node.numBitsSkipped
+		}
+		if child.numBitsSkipped < commonBits {
+			commonBits = child.numBitsSkipped
+		}
+		if commonBits < child.numBitsSkipped {
+			split, err := newPathPrefixTrie(node.network, commonBits, p.config)
+			if err != nil {
+				return err
+			}
+			if err := p.placeInSlots(slots, split); err != nil {
+				return err
+			}
+			if err := p.resize(); err != nil {
+				return err
+			}
+			child = split
+		}
+		return child.graft(node)
+	}
+
+	if err := p.placeInSlots(slots, node); err != nil {
+		return err
+	}
+	return p.resize()
+}
+
+// absorbChildren grafts each distinct child of node onto p, used when node
+// and p represent the same network so node's descendants are preserved
+// rather than discarded along with node itself. A shallow child can occupy
+// more than one of node's slots, so each distinct child is only grafted
+// once.
+func (p *PrefixTrie) absorbChildren(node *PrefixTrie) error {
+	for i, child := range node.children {
+		if child == nil || child == p {
+			continue
+		}
+		duplicate := false
+		for _, prior := range node.children[:i] {
+			if prior == child {
+				duplicate = true
+				break
+			}
+		}
+		if duplicate {
+			continue
+		}
+		if err := p.graft(child); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// matchingSlots returns the indices, among p's current 2^numBitsHandled
+// children, that network could occupy. This is normally exactly one slot,
+// since network's own declared prefix reaches past every bit p consumes
+// and so determines all of them. But if network's prefix ends before that
+// (a node that's been level-compressed to handle more bits than a
+// shallower network declares), network doesn't have enough real bits to
+// pick a single slot: the slots beyond its own mask length are zero
+// padding, not a real choice, so it must occupy every slot consistent
+// with the bits it does define.
+func (p *PrefixTrie) matchingSlots(network rnet.Network) ([]uint32, error) {
+	start := p.targetBitPosition()
+	k := p.numBitsHandled
+	if k > start+1 {
+		k = start + 1
+	}
+	ones, _ := network.IPNet.Mask.Size()
+	definedBits := k
+	if uint(ones) <= p.numBitsSkipped {
+		definedBits = 0
+	} else if avail := uint(ones) - p.numBitsSkipped; avail < k {
+		definedBits = avail
+	}
+
+	var base uint32
+	for i := uint(0); i < definedBits; i++ {
+		bit, err := network.Number.Bit(start - i)
 		if err != nil {
+			return nil, err
+		}
+		base = base<<1 | bit
+	}
+	deficit := k - definedBits
+	base <<= deficit
+
+	slots := make([]uint32, 1<<deficit)
+	for i := range slots {
+		slots[i] = base | uint32(i)
+	}
+	return slots, nil
+}
+
+// uniformOccupant returns the single child occupying every slot in slots,
+// or nil if the slots are currently empty, or occupied by more than one
+// distinct child.
+func (p *PrefixTrie) uniformOccupant(slots []uint32) *PrefixTrie {
+	child := p.children[slots[0]]
+	if child == nil {
+		return nil
+	}
+	for _, slot := range slots[1:] {
+		if p.children[slot] != child {
+			return nil
+		}
+	}
+	return child
+}
+
+// placeInSlots installs newNode at every index in slots. Whatever
+// children previously occupied those slots are grafted onto newNode
+// first -- exactly once each, however many of the given slots they
+// occupied, and via graft rather than a raw re-slot, so a slot holding a
+// child that only partially agrees with newNode still gets split
+// correctly instead of nested under it unconditionally.
+func (p *PrefixTrie) placeInSlots(slots []uint32, newNode *PrefixTrie) error {
+	for i, slot := range slots {
+		occupant := p.children[slot]
+		if occupant == nil || occupant == newNode {
+			continue
+		}
+		duplicate := false
+		for _, prior := range slots[:i] {
+			if p.children[prior] == occupant {
+				duplicate = true
+				break
+			}
+		}
+		if duplicate {
+			continue
+		}
+		if err := newNode.graft(occupant); err != nil {
 			return err
 		}
 	}
-	return child.insert(network)
+	for _, slot := range slots {
+		p.children[slot] = newNode
+	}
+	newNode.parent = p
+	return nil
 }
 
 func (p *PrefixTrie) insertPrefix(bits uint32, prefix *PrefixTrie) error {
@@ -215,13 +621,22 @@ func (p *PrefixTrie) insertPrefix(bits uint32, prefix *PrefixTrie) error {
 	return nil
 }
 
-func (p *PrefixTrie) remove(network rnet.Network) (*net.IPNet, error) {
+func (p *PrefixTrie) remove(network rnet.Network) (*PrefixTrie, error) {
 	if p.hasEntry && p.network.Equal(network) {
-		if p.childrenCount() > 1 {
+		removed := &PrefixTrie{network: p.network, hasEntry: true, entry: p.entry}
+		if p.childrenCount() > 1 || p.parent == nil {
+			// Either p keeps more than one child and must stay in place to
+			// hold them, or p is the root, which has no parent slot to be
+			// promoted into or cleared from -- either way just drop the
+			// entry and leave the node (and any children) where they are.
 			p.hasEntry = false
+			p.entry = nil
 		} else {
-			// Has 0 or 1 child.
-			parentBits, err := p.parent.targetBitFromIP(network.Number)
+			// Has 0 or 1 child. p itself may be a shallow node duplicated
+			// across more than one of the parent's slots (see
+			// matchingSlots), so every slot holding it needs clearing,
+			// not just the one a single targetBitFromIP lookup would find.
+			parentSlots, err := p.parent.matchingSlots(p.network)
 			if err != nil {
 				return nil, err
 			}
@@ -232,9 +647,17 @@ func (p *PrefixTrie) remove(network rnet.Network) (*net.IPNet, error) {
 					break
 				}
 			}
-			p.parent.children[parentBits] = skipChild
+			for _, slot := range parentSlots {
+				p.parent.children[slot] = skipChild
+			}
+			if skipChild != nil {
+				skipChild.parent = p.parent
+			}
+			if err := p.parent.prune(); err != nil {
+				return nil, err
+			}
 		}
-		return &network.IPNet, nil
+		return removed, nil
 	}
 	bit, err := p.targetBitFromIP(network.Number)
 	if err != nil {
@@ -258,40 +681,160 @@ func (p *PrefixTrie) childrenCount() int {
 }
 
 func (p *PrefixTrie) targetBitPosition() uint {
-	return 31 - p.numBitsSkipped
+	return p.network.Number.Bits() - 1 - p.numBitsSkipped
 }
 
+// targetBitFromIP returns the numBitsHandled-bit index (0 to 2^numBitsHandled-1)
+// of n's bits immediately following the ones p has already skipped, most
+// significant of those bits first.
 func (p *PrefixTrie) targetBitFromIP(n rnet.NetworkNumber) (uint32, error) {
-	return n.Bit(p.targetBitPosition())
+	start := p.targetBitPosition()
+	k := p.numBitsHandled
+	if k > start+1 {
+		k = start + 1
+	}
+	var index uint32
+	for i := uint(0); i < k; i++ {
+		bit, err := n.Bit(start - i)
+		if err != nil {
+			return 0, err
+		}
+		index = index<<1 | bit
+	}
+	return index, nil
 }
 
-func (p *PrefixTrie) level() int {
-	if p.parent == nil {
-		return 0
+// prune removes p from its parent and resizes it if p has ended up with no
+// entry and no children of its own -- a path-compression split node whose
+// last real occupant was just removed -- and repeats up the chain, so a
+// removal doesn't leave a trail of now-pointless split nodes (which would
+// otherwise also hold a node's fill fraction artificially high and block
+// resize's shrink path forever). Stops as soon as it reaches the root or a
+// node still worth keeping.
+func (p *PrefixTrie) prune() error {
+	for p.parent != nil && !p.hasEntry && p.childrenCount() == 0 {
+		parent := p.parent
+		slots, err := parent.matchingSlots(p.network)
+		if err != nil {
+			return err
+		}
+		for _, slot := range slots {
+			if parent.children[slot] == p {
+				parent.children[slot] = nil
+			}
+		}
+		p = parent
 	}
-	return p.parent.level() + 1
+	return p.resize()
 }
 
-// walkDepth walks the trie in depth order, for unit testing.
-func (p *PrefixTrie) walkDepth() <-chan net.IPNet {
-	networks := make(chan net.IPNet)
-	go func() {
-		if p.hasEntry {
-			networks <- p.network.IPNet
+// resize grows or shrinks p's level compression to match its configured
+// fill thresholds, based on the fraction of its 2^numBitsHandled child
+// slots that are populated.
+func (p *PrefixTrie) resize() error {
+	for p.numBitsHandled < p.config.maxBitsHandled && p.numBitsHandled < p.targetBitPosition()+1 {
+		if !p.fillFractionAtLeast(p.config.expandThreshold) {
+			break
 		}
-		subNetworks := []<-chan net.IPNet{}
-		for _, trie := range p.children {
-			if trie == nil {
-				continue
-			}
-			subNetworks = append(subNetworks, trie.walkDepth())
+		if err := p.expand(); err != nil {
+			return err
+		}
+	}
+	for p.numBitsHandled > p.config.minBitsHandled {
+		if p.fillFractionAtLeast(p.config.shrinkThreshold) {
+			break
 		}
-		for _, subNetwork := range subNetworks {
-			for network := range subNetwork {
-				networks <- network
+		if err := p.shrink(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *PrefixTrie) fillFractionAtLeast(fraction float64) bool {
+	slots := 1 << p.numBitsHandled
+	return float64(p.childrenCount())/float64(slots) >= fraction
+}
+
+// expand increases numBitsHandled by one. Children whose own mask reaches
+// past the newly added bit are re-slotted by reading that bit off of their
+// network number; children whose mask ends at or before the old boundary
+// don't know that bit, so the same child is placed in both of the slots
+// its old slot split into.
+func (p *PrefixTrie) expand() error {
+	oldChildren := p.children
+	oldNumBitsHandled := p.numBitsHandled
+	newBitPosition := p.targetBitPosition() - oldNumBitsHandled
+	p.numBitsHandled = oldNumBitsHandled + 1
+	p.children = make([]*PrefixTrie, 1<<p.numBitsHandled)
+	for oldIndex, child := range oldChildren {
+		if child == nil {
+			continue
+		}
+		child.parent = p
+		if child.numBitsSkipped <= p.numBitsSkipped+oldNumBitsHandled {
+			p.children[uint32(oldIndex)<<1] = child
+			p.children[uint32(oldIndex)<<1|1] = child
+			continue
+		}
+		bit, err := child.network.Number.Bit(newBitPosition)
+		if err != nil {
+			return err
+		}
+		p.children[uint32(oldIndex)<<1|bit] = child
+	}
+	return nil
+}
+
+// shrink decreases numBitsHandled by one, pairing up children that now
+// share a slot. A slot whose pair both have a child is pushed back down as
+// a path-compressed one-bit subtrie, built with insertPrefix.
+func (p *PrefixTrie) shrink() error {
+	oldChildren := p.children
+	newNumBitsHandled := p.numBitsHandled - 1
+	newChildren := make([]*PrefixTrie, 1<<newNumBitsHandled)
+	for i := range newChildren {
+		left, right := oldChildren[2*i], oldChildren[2*i+1]
+		switch {
+		case left == nil && right == nil:
+			continue
+		case left == right:
+			// Same child duplicated across both slots by a prior expand,
+			// because its own mask didn't reach the bit being dropped.
+			newChildren[i] = left
+			left.parent = p
+		case right == nil:
+			newChildren[i] = left
+			left.parent = p
+		case left == nil:
+			newChildren[i] = right
+			right.parent = p
+		default:
+			mid, err := newPathPrefixTrie(left.network, p.numBitsSkipped+newNumBitsHandled, p.config)
+			if err != nil {
+				return err
+			}
+			mid.parent = p
+			newChildren[i] = mid
+			for _, c := range [2]*PrefixTrie{left, right} {
+				bit, err := mid.targetBitFromIP(c.network.Number)
+				if err != nil {
+					return err
+				}
+				if err := mid.insertPrefix(bit, c); err != nil {
+					return err
+				}
 			}
 		}
-		close(networks)
-	}()
-	return networks
+	}
+	p.numBitsHandled = newNumBitsHandled
+	p.children = newChildren
+	return nil
+}
+
+func (p *PrefixTrie) level() int {
+	if p.parent == nil {
+		return 0
+	}
+	return p.parent.level() + 1
 }
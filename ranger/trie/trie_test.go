@@ -0,0 +1,550 @@
+package trie
+
+import (
+	"math/rand"
+	"net"
+	"strings"
+	"testing"
+)
+
+func mustParseCIDR(t *testing.T, s string) net.IPNet {
+	t.Helper()
+	_, n, err := net.ParseCIDR(s)
+	if err != nil {
+		t.Fatalf("ParseCIDR(%q): %v", s, err)
+	}
+	return *n
+}
+
+func TestInsertContainsRemove(t *testing.T) {
+	tr := NewPrefixTreeV4()
+	networks := []string{"192.168.0.0/16", "10.0.0.0/8", "192.168.1.0/24"}
+	for _, n := range networks {
+		if err := tr.Insert(mustParseCIDR(t, n)); err != nil {
+			t.Fatalf("Insert(%s): %v", n, err)
+		}
+	}
+
+	for _, tc := range []struct {
+		ip   string
+		want bool
+	}{
+		{"192.168.1.1", true},
+		{"192.168.2.1", true},
+		{"10.1.2.3", true},
+		{"11.0.0.1", false},
+	} {
+		got, err := tr.Contains(net.ParseIP(tc.ip))
+		if err != nil {
+			t.Fatalf("Contains(%s): %v", tc.ip, err)
+		}
+		if got != tc.want {
+			t.Errorf("Contains(%s) = %v, want %v", tc.ip, got, tc.want)
+		}
+	}
+
+	if _, err := tr.Remove(mustParseCIDR(t, "192.168.1.0/24")); err != nil {
+		t.Fatalf("Remove: %v", err)
+	}
+	got, err := tr.Contains(net.ParseIP("192.168.1.1"))
+	if err != nil {
+		t.Fatalf("Contains after remove: %v", err)
+	}
+	if !got {
+		t.Errorf("Contains(192.168.1.1) = false after removing the more specific /24, want true (still covered by /16)")
+	}
+}
+
+func TestContainingNetworks(t *testing.T) {
+	tr := NewPrefixTreeV4()
+	for _, n := range []string{"10.0.0.0/8", "10.1.0.0/16", "10.1.1.0/24"} {
+		if err := tr.Insert(mustParseCIDR(t, n)); err != nil {
+			t.Fatalf("Insert(%s): %v", n, err)
+		}
+	}
+	got, err := tr.ContainingNetworks(net.ParseIP("10.1.1.1"))
+	if err != nil {
+		t.Fatalf("ContainingNetworks: %v", err)
+	}
+	want := []string{"10.0.0.0/8", "10.1.0.0/16", "10.1.1.0/24"}
+	if len(got) != len(want) {
+		t.Fatalf("ContainingNetworks returned %d networks, want %d: %v", len(got), len(want), got)
+	}
+	for i, n := range got {
+		if n.String() != want[i] {
+			t.Errorf("ContainingNetworks[%d] = %s, want %s (ascending prefix order)", i, n.String(), want[i])
+		}
+	}
+}
+
+func TestEntryAPI(t *testing.T) {
+	tr := NewPrefixTreeV4()
+	if err := tr.InsertEntry(mustParseCIDR(t, "10.0.0.0/8"), "tag-a"); err != nil {
+		t.Fatalf("InsertEntry: %v", err)
+	}
+	if err := tr.InsertEntry(mustParseCIDR(t, "10.1.0.0/16"), "tag-b"); err != nil {
+		t.Fatalf("InsertEntry: %v", err)
+	}
+
+	entries, err := tr.ContainingNetworkEntries(net.ParseIP("10.1.2.3"))
+	if err != nil {
+		t.Fatalf("ContainingNetworkEntries: %v", err)
+	}
+	if len(entries) != 2 || entries[0].Value != "tag-a" || entries[1].Value != "tag-b" {
+		t.Fatalf("ContainingNetworkEntries = %+v, want [tag-a tag-b] in ascending prefix order", entries)
+	}
+
+	removed, err := tr.RemoveEntry(mustParseCIDR(t, "10.1.0.0/16"))
+	if err != nil {
+		t.Fatalf("RemoveEntry: %v", err)
+	}
+	if removed == nil || removed.Value != "tag-b" {
+		t.Fatalf("RemoveEntry returned %+v, want entry with value tag-b", removed)
+	}
+}
+
+// TestSplitPointClampedToShorterMask guards against a regression where
+// inserting a broad network after a narrower one sharing its leading zero
+// bits produced a split node masked more specifically than the broad
+// network itself, pruning it out of later lookups. Level compression is
+// disabled here (WithMaxBitsHandled(1)) to isolate the split-point
+// computation itself from the separate level-compression concerns covered
+// in TestLevelCompressionTransitions.
+func TestSplitPointClampedToShorterMask(t *testing.T) {
+	tests := []struct {
+		name          string
+		v6            bool
+		narrow, broad string
+		ip            string
+	}{
+		{
+			name:   "ipv4 broad supernet inserted after narrow sibling",
+			narrow: "12.0.0.0/6",
+			broad:  "0.0.0.0/1",
+			ip:     "63.1.1.1",
+		},
+		{
+			name:   "ipv6 broad supernet inserted after narrow sibling",
+			v6:     true,
+			narrow: "4000::/4",
+			broad:  "::/1",
+			ip:     "7fff::1",
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			var tr *PrefixTrie
+			if tc.v6 {
+				tr = NewPrefixTreeV6(WithMaxBitsHandled(1))
+			} else {
+				tr = NewPrefixTreeV4(WithMaxBitsHandled(1))
+			}
+			if err := tr.Insert(mustParseCIDR(t, tc.narrow)); err != nil {
+				t.Fatalf("Insert(%s): %v", tc.narrow, err)
+			}
+			if err := tr.Insert(mustParseCIDR(t, tc.broad)); err != nil {
+				t.Fatalf("Insert(%s): %v", tc.broad, err)
+			}
+			got, err := tr.Contains(net.ParseIP(tc.ip))
+			if err != nil {
+				t.Fatalf("Contains(%s): %v", tc.ip, err)
+			}
+			if !got {
+				t.Errorf("Contains(%s) = false, want true: %s should still be reachable under %s after %s was inserted first",
+					tc.ip, tc.ip, tc.broad, tc.narrow)
+			}
+		})
+	}
+}
+
+// TestGraftPreservesExistingChildren guards against a regression where
+// inserting a network that exactly matches an existing, childless-entry
+// path-compression split node (one created purely to hold other networks
+// apart, with children of its own but no entry) discarded that split
+// node's children instead of keeping them -- silent, irrecoverable data
+// loss reachable through an ordinary Insert once level compression has
+// spread the split node non-uniformly across a level-compressed ancestor's
+// slots. See also TestRandomInsertRemoveAgainstReference, which found this
+// independently of knowing the structure in advance.
+func TestGraftPreservesExistingChildren(t *testing.T) {
+	tr := NewPrefixTreeV4()
+	for _, n := range []string{"204.232.237.104/32", "206.0.0.0/7", "246.139.66.0/25"} {
+		if err := tr.Insert(mustParseCIDR(t, n)); err != nil {
+			t.Fatalf("Insert(%s): %v", n, err)
+		}
+	}
+	if err := tr.Insert(mustParseCIDR(t, "192.0.0.0/2")); err != nil {
+		t.Fatalf("Insert(192.0.0.0/2): %v", err)
+	}
+
+	for _, tc := range []struct {
+		ip   string
+		want bool
+	}{
+		{"204.232.237.104", true},
+		{"206.1.2.3", true},
+		{"246.139.66.1", true},
+		{"192.0.0.1", true},
+		{"128.0.0.1", false},
+	} {
+		got, err := tr.Contains(net.ParseIP(tc.ip))
+		if err != nil {
+			t.Fatalf("Contains(%s): %v", tc.ip, err)
+		}
+		if got != tc.want {
+			t.Errorf("Contains(%s) = %v, want %v after inserting 192.0.0.0/2", tc.ip, got, tc.want)
+		}
+	}
+}
+
+// TestRemoveRootEntry guards against a nil-pointer panic when the network
+// removed is the root's own (e.g. after Insert("0.0.0.0/0")): the root has
+// no parent to promote a remaining child into or clear a slot on, so it
+// must drop its entry in place instead.
+func TestRemoveRootEntry(t *testing.T) {
+	tr := NewPrefixTreeV4()
+	if err := tr.Insert(mustParseCIDR(t, "0.0.0.0/0")); err != nil {
+		t.Fatalf("Insert(0.0.0.0/0): %v", err)
+	}
+	if _, err := tr.Remove(mustParseCIDR(t, "0.0.0.0/0")); err != nil {
+		t.Fatalf("Remove(0.0.0.0/0): %v", err)
+	}
+	got, err := tr.Contains(net.ParseIP("1.2.3.4"))
+	if err != nil {
+		t.Fatalf("Contains: %v", err)
+	}
+	if got {
+		t.Errorf("Contains(1.2.3.4) = true after removing the root entry 0.0.0.0/0, want false")
+	}
+}
+
+// TestRemovePromotesSkipChildParent guards against a regression where
+// remove(), on promoting a removed node's sole remaining child up into the
+// parent's now-freed slots, left that child's own parent pointer stale --
+// still referencing the removed node instead of its new parent. The child
+// itself kept working for direct lookups, but any later remove() of that
+// child (or a prune() walking up through it) used the stale parent pointer
+// and silently mutated the wrong node's children, leaving the trie's real
+// parent slot untouched despite Remove reporting success. See also
+// TestRandomInsertRemoveAgainstReference, which found this independently.
+func TestRemovePromotesSkipChildParent(t *testing.T) {
+	tr := NewPrefixTreeV4()
+	for _, n := range []string{
+		"32.0.0.0/4", "32.0.0.0/5", "40.0.0.0/7",
+	} {
+		if err := tr.Insert(mustParseCIDR(t, n)); err != nil {
+			t.Fatalf("Insert(%s): %v", n, err)
+		}
+	}
+	if _, err := tr.Remove(mustParseCIDR(t, "32.0.0.0/5")); err != nil {
+		t.Fatalf("Remove(32.0.0.0/5): %v", err)
+	}
+	for _, n := range []string{
+		"159.0.0.0/8", "192.0.0.0/2", "64.0.0.0/3", "8.0.0.0/5",
+	} {
+		if err := tr.Insert(mustParseCIDR(t, n)); err != nil {
+			t.Fatalf("Insert(%s): %v", n, err)
+		}
+	}
+	if _, err := tr.Remove(mustParseCIDR(t, "32.0.0.0/4")); err != nil {
+		t.Fatalf("Remove(32.0.0.0/4): %v", err)
+	}
+	if err := tr.Insert(mustParseCIDR(t, "240.0.0.0/7")); err != nil {
+		t.Fatalf("Insert(240.0.0.0/7): %v", err)
+	}
+	if _, err := tr.Remove(mustParseCIDR(t, "240.0.0.0/7")); err != nil {
+		t.Fatalf("Remove(240.0.0.0/7): %v", err)
+	}
+
+	if _, err := tr.Remove(mustParseCIDR(t, "40.0.0.0/7")); err != nil {
+		t.Fatalf("Remove(40.0.0.0/7): %v", err)
+	}
+	got, err := tr.Contains(net.ParseIP("40.1.2.3"))
+	if err != nil {
+		t.Fatalf("Contains: %v", err)
+	}
+	if got {
+		t.Errorf("Contains(40.1.2.3) = true after removing 40.0.0.0/7, want false")
+	}
+}
+
+// TestRandomInsertRemoveAgainstReference is a seeded, deterministic
+// differential fuzz test: it drives random Insert/Remove calls against a
+// brute-force reference (a set of currently-inserted networks, checked by
+// linear scan, keyed by CIDR string the same way the trie itself treats a
+// repeated Insert of the same network as overwriting rather than
+// duplicating) and asserts Contains agrees at every step. Removal picks are
+// made against an explicit insertion-order slice rather than by ranging over
+// the reference map directly, since Go's map iteration order isn't
+// reproducible across runs even with a fixed rand.Source. It exists because
+// TestGraftPreservesExistingChildren and TestRemovePromotesSkipChildParent
+// were both originally found this way, against states too specific to have
+// been anticipated by hand alone.
+func TestRandomInsertRemoveAgainstReference(t *testing.T) {
+	rng := rand.New(rand.NewSource(42))
+	tr := NewPrefixTreeV4()
+	reference := make(map[string]net.IPNet)
+	var order []string
+
+	randomNetwork := func() net.IPNet {
+		ip := net.IPv4(byte(rng.Intn(256)), byte(rng.Intn(256)), byte(rng.Intn(256)), byte(rng.Intn(256))).To4()
+		ones := rng.Intn(9) // biased toward short masks, to force overlap and splits
+		mask := net.CIDRMask(ones, 32)
+		return net.IPNet{IP: ip.Mask(mask), Mask: mask}
+	}
+	referenceContains := func(ip net.IP) bool {
+		for _, n := range reference {
+			if n.Contains(ip) {
+				return true
+			}
+		}
+		return false
+	}
+
+	const ops = 5000
+	for i := 0; i < ops; i++ {
+		if len(order) > 0 && rng.Intn(3) == 0 {
+			idx := rng.Intn(len(order))
+			key := order[idx]
+			order = append(order[:idx], order[idx+1:]...)
+			n, ok := reference[key]
+			if !ok {
+				continue // already removed via a re-inserted duplicate key
+			}
+			if _, err := tr.Remove(n); err != nil {
+				t.Fatalf("op %d: Remove(%s): %v", i, n.String(), err)
+			}
+			delete(reference, key)
+		} else {
+			n := randomNetwork()
+			key := n.String()
+			if _, exists := reference[key]; !exists {
+				order = append(order, key)
+			}
+			if err := tr.Insert(n); err != nil {
+				t.Fatalf("op %d: Insert(%s): %v", i, n.String(), err)
+			}
+			reference[key] = n
+		}
+
+		for j := 0; j < 5; j++ {
+			ip := net.IPv4(byte(rng.Intn(256)), byte(rng.Intn(256)), byte(rng.Intn(256)), byte(rng.Intn(256)))
+			want := referenceContains(ip)
+			got, err := tr.Contains(ip)
+			if err != nil {
+				t.Fatalf("op %d: Contains(%s): %v", i, ip, err)
+			}
+			if got != want {
+				t.Fatalf("op %d: Contains(%s) = %v, want %v (reference has %d networks)", i, ip, got, want, len(reference))
+			}
+		}
+	}
+}
+
+func TestWalk(t *testing.T) {
+	tr := NewPrefixTreeV4()
+	for _, n := range []string{"10.1.1.0/24", "10.0.0.0/8", "10.1.0.0/16", "192.168.0.0/16"} {
+		if err := tr.Insert(mustParseCIDR(t, n)); err != nil {
+			t.Fatalf("Insert(%s): %v", n, err)
+		}
+	}
+
+	var got []string
+	if err := tr.Walk(func(network net.IPNet, _ interface{}) bool {
+		got = append(got, network.String())
+		return true
+	}); err != nil {
+		t.Fatalf("Walk: %v", err)
+	}
+	want := []string{"10.0.0.0/8", "10.1.0.0/16", "10.1.1.0/24", "192.168.0.0/16"}
+	if len(got) != len(want) {
+		t.Fatalf("Walk visited %v, want %v", got, want)
+	}
+	for i, n := range got {
+		if n != want[i] {
+			t.Errorf("Walk[%d] = %s, want %s (ancestor-before-descendant prefix order)", i, n, want[i])
+		}
+	}
+
+	var stopped []string
+	if err := tr.Walk(func(network net.IPNet, _ interface{}) bool {
+		stopped = append(stopped, network.String())
+		return false
+	}); err != nil {
+		t.Fatalf("Walk: %v", err)
+	}
+	if len(stopped) != 1 || stopped[0] != "10.0.0.0/8" {
+		t.Errorf("Walk returning false on first call visited %v, want exactly [10.0.0.0/8]", stopped)
+	}
+}
+
+func TestWalkSubtree(t *testing.T) {
+	tr := NewPrefixTreeV4()
+	for _, n := range []string{"10.1.1.0/24", "10.0.0.0/8", "10.1.0.0/16", "192.168.0.0/16"} {
+		if err := tr.Insert(mustParseCIDR(t, n)); err != nil {
+			t.Fatalf("Insert(%s): %v", n, err)
+		}
+	}
+
+	var got []string
+	if err := tr.WalkSubtree(mustParseCIDR(t, "10.0.0.0/8"), func(network net.IPNet, _ interface{}) bool {
+		got = append(got, network.String())
+		return true
+	}); err != nil {
+		t.Fatalf("WalkSubtree: %v", err)
+	}
+	want := []string{"10.0.0.0/8", "10.1.0.0/16", "10.1.1.0/24"}
+	if len(got) != len(want) {
+		t.Fatalf("WalkSubtree(10.0.0.0/8) visited %v, want %v", got, want)
+	}
+	for i, n := range got {
+		if n != want[i] {
+			t.Errorf("WalkSubtree[%d] = %s, want %s", i, n, want[i])
+		}
+	}
+
+	var none []string
+	if err := tr.WalkSubtree(mustParseCIDR(t, "172.16.0.0/12"), func(network net.IPNet, _ interface{}) bool {
+		none = append(none, network.String())
+		return true
+	}); err != nil {
+		t.Fatalf("WalkSubtree: %v", err)
+	}
+	if len(none) != 0 {
+		t.Errorf("WalkSubtree(172.16.0.0/12) visited %v, want none", none)
+	}
+}
+
+func TestLoadFromReader(t *testing.T) {
+	tr := NewPrefixTreeV4()
+	input := strings.NewReader("# comment\n10.0.0.0/8\n\n192.168.0.0/16\n")
+	n, err := tr.LoadFromReader(input)
+	if err != nil {
+		t.Fatalf("LoadFromReader: %v", err)
+	}
+	if n != 2 {
+		t.Errorf("LoadFromReader returned count %d, want 2", n)
+	}
+	got, err := tr.Contains(net.ParseIP("10.1.2.3"))
+	if err != nil {
+		t.Fatalf("Contains: %v", err)
+	}
+	if !got {
+		t.Errorf("Contains(10.1.2.3) = false after LoadFromReader, want true")
+	}
+
+	if _, err := tr.LoadFromReader(strings.NewReader("not-a-cidr\n")); err == nil {
+		t.Errorf("LoadFromReader(invalid line) = nil error, want an error")
+	}
+}
+
+// TestLongestPrefixMatch guards the same false-negative pruning bug covered
+// by TestSplitPointClampedToShorterMask and TestLevelCompressionTransitions,
+// but through LongestPrefixMatch's own traversal: it must still find the
+// broad supernet after a narrower, more specific network sharing its
+// leading bits was inserted first, and prefer the more specific of two
+// matching networks.
+func TestLongestPrefixMatch(t *testing.T) {
+	tr := NewPrefixTreeV4()
+	for _, n := range []string{"12.0.0.0/6", "0.0.0.0/1", "63.1.0.0/16"} {
+		if err := tr.Insert(mustParseCIDR(t, n)); err != nil {
+			t.Fatalf("Insert(%s): %v", n, err)
+		}
+	}
+
+	network, _, err := tr.LongestPrefixMatch(net.ParseIP("63.1.1.1"))
+	if err != nil {
+		t.Fatalf("LongestPrefixMatch: %v", err)
+	}
+	if network == nil || network.String() != "63.1.0.0/16" {
+		t.Fatalf("LongestPrefixMatch(63.1.1.1) = %v, want 63.1.0.0/16", network)
+	}
+
+	network, _, err = tr.LongestPrefixMatch(net.ParseIP("127.1.1.1"))
+	if err != nil {
+		t.Fatalf("LongestPrefixMatch: %v", err)
+	}
+	if network == nil || network.String() != "0.0.0.0/1" {
+		t.Fatalf("LongestPrefixMatch(127.1.1.1) = %v, want 0.0.0.0/1 (reachable only via the broad supernet)", network)
+	}
+
+	network, _, err = tr.LongestPrefixMatch(net.ParseIP("200.0.0.1"))
+	if err != nil {
+		t.Fatalf("LongestPrefixMatch: %v", err)
+	}
+	if network != nil {
+		t.Errorf("LongestPrefixMatch(200.0.0.1) = %v, want nil", network)
+	}
+}
+
+// TestLevelCompressionTransitions exercises a node actually expanding (by
+// inserting enough siblings under it to cross the expand threshold) and
+// shrinking back down (by removing them again), checking containment
+// holds throughout. It also covers the level-compression-specific
+// counterpart to TestSplitPointClampedToShorterMask: once a node has
+// expanded to handle more than one bit, a freshly inserted network whose
+// own mask is shorter than the bits the node now consumes doesn't have
+// enough real bits to land in a single child slot, and must occupy every
+// slot consistent with the bits it does define rather than just the one a
+// naive zero-padded lookup would pick.
+func TestLevelCompressionTransitions(t *testing.T) {
+	tr := NewPrefixTreeV4()
+
+	siblings := []string{"64.0.0.0/8", "65.0.0.0/8", "66.0.0.0/8", "67.0.0.0/8"}
+	for _, n := range siblings {
+		if err := tr.Insert(mustParseCIDR(t, n)); err != nil {
+			t.Fatalf("Insert(%s): %v", n, err)
+		}
+	}
+	if tr.numBitsHandled <= 1 {
+		t.Fatalf("root numBitsHandled = %d after inserting %d siblings, want > 1 (expand should have triggered)", tr.numBitsHandled, len(siblings))
+	}
+
+	if err := tr.Insert(mustParseCIDR(t, "0.0.0.0/1")); err != nil {
+		t.Fatalf("Insert(0.0.0.0/1): %v", err)
+	}
+	for _, tc := range []struct {
+		ip   string
+		want bool
+	}{
+		{"64.1.1.1", true},  // inside 64.0.0.0/8
+		{"1.2.3.4", true},   // only inside the broad 0.0.0.0/1
+		{"127.1.1.1", true}, // also only inside 0.0.0.0/1, diverging from every sibling above
+		{"200.0.0.1", false},
+	} {
+		got, err := tr.Contains(net.ParseIP(tc.ip))
+		if err != nil {
+			t.Fatalf("Contains(%s): %v", tc.ip, err)
+		}
+		if got != tc.want {
+			t.Errorf("Contains(%s) = %v, want %v", tc.ip, got, tc.want)
+		}
+	}
+
+	for _, n := range siblings {
+		if _, err := tr.Remove(mustParseCIDR(t, n)); err != nil {
+			t.Fatalf("Remove(%s): %v", n, err)
+		}
+	}
+	got, err := tr.Contains(net.ParseIP("127.1.1.1"))
+	if err != nil {
+		t.Fatalf("Contains(127.1.1.1): %v", err)
+	}
+	if !got {
+		t.Errorf("Contains(127.1.1.1) = false after removing the siblings, want true: still covered by 0.0.0.0/1")
+	}
+
+	if _, err := tr.Remove(mustParseCIDR(t, "0.0.0.0/1")); err != nil {
+		t.Fatalf("Remove(0.0.0.0/1): %v", err)
+	}
+	if tr.numBitsHandled != 1 {
+		t.Errorf("root numBitsHandled = %d on an empty trie, want 1 (shrink should have fully reversed the earlier expand)", tr.numBitsHandled)
+	}
+	got, err = tr.Contains(net.ParseIP("127.1.1.1"))
+	if err != nil {
+		t.Fatalf("Contains(127.1.1.1): %v", err)
+	}
+	if got {
+		t.Errorf("Contains(127.1.1.1) = true on an empty trie, want false")
+	}
+}